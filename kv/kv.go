@@ -0,0 +1,373 @@
+// Package kv provides a simple key-value store that is backed by Badger and
+// synced to a Charm Cloud backend.
+package kv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/charmbracelet/charm/client"
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// ErrEmptyKey is returned whenever an operation is given an empty key.
+var ErrEmptyKey = errors.New("kv: key must not be empty")
+
+// ErrKeyNotFound is returned by Get and PrevValue when the given key has no
+// value in the store.
+var ErrKeyNotFound = errors.New("kv: key not found")
+
+// ErrInvalidKeyRotationDuration is returned by OptionsWithEncryption when
+// given a non-positive key rotation interval.
+var ErrInvalidKeyRotationDuration = errors.New("kv: key rotation duration must be greater than zero")
+
+// KV is a key-value store backed by Badger that syncs its data to the
+// Charm Cloud, encrypted with the Charm user's key.
+type KV struct {
+	db                  *badger.DB
+	cc                  *client.Client
+	name                string
+	maxWatchMessageSize int
+	syncedUpTo          uint64
+}
+
+// Open opens (or creates, if it doesn't already exist) a KV database for the
+// given name, owned by the Charm user behind the given client.
+func Open(cc *client.Client, name string, opt badger.Options, opts ...Option) (*KV, error) {
+	db, err := badger.Open(opt)
+	if err != nil {
+		return nil, fmt.Errorf("could not open badger db: %w", err)
+	}
+	kv := &KV{db: db, cc: cc, name: name, maxWatchMessageSize: defaultMaxWatchMessageSize}
+	for _, o := range opts {
+		o(kv)
+	}
+	return kv, nil
+}
+
+// OptionsWithEncryption returns a copy of the given Badger options with
+// encryption-at-rest enabled, using key as the encryption key and
+// keyRotationDays as the interval, in days, at which Badger rotates the
+// internal data encryption key.
+func OptionsWithEncryption(opt badger.Options, key []byte, keyRotationDays int) (badger.Options, error) {
+	if keyRotationDays <= 0 {
+		return opt, ErrInvalidKeyRotationDuration
+	}
+	return opt.
+		WithEncryptionKey(key).
+		WithEncryptionKeyRotationDuration(time.Duration(keyRotationDays) * 24 * time.Hour), nil
+}
+
+// Get returns the value for the given key.
+func (kv *KV) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	var value []byte
+	err := kv.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get value for key %q: %w", key, err)
+	}
+	return value, nil
+}
+
+// setConfig holds the options for a single Set call.
+type setConfig struct {
+	ttl time.Duration
+}
+
+// SetOption configures a single Set call.
+type SetOption func(*setConfig)
+
+// WithTTL makes the key expire, and become eligible for removal by
+// Badger's garbage collector, after ttl elapses. It's meant to let callers
+// build locks and leases on top of the store. Badger stores the expiry as a
+// whole Unix second, so the key can expire up to a second before ttl has
+// fully elapsed.
+func WithTTL(ttl time.Duration) SetOption {
+	return func(c *setConfig) {
+		c.ttl = ttl
+	}
+}
+
+// Set sets a value for the given key.
+func (kv *KV) Set(key, value []byte, opts ...SetOption) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	var cfg setConfig
+	for _, o := range opts {
+		o(&cfg)
+	}
+	return kv.db.Update(func(txn *badger.Txn) error {
+		entry := badger.NewEntry(key, value)
+		if cfg.ttl > 0 {
+			entry = entry.WithTTL(cfg.ttl)
+		}
+		return txn.SetEntry(entry)
+	})
+}
+
+// SetReader sets a value for the given key, reading the value from r.
+func (kv *KV) SetReader(key []byte, r io.Reader) error {
+	value, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("could not read value for key %q: %w", key, err)
+	}
+	return kv.Set(key, value)
+}
+
+// Delete deletes a key and its value.
+func (kv *KV) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	return kv.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+}
+
+// Sync flushes outstanding local writes to disk, then pushes everything
+// written since the last Sync up to this KV's copy on the Charm server.
+// That server-side copy is what Watch, and other clients of the same
+// Charm user, actually observe.
+func (kv *KV) Sync() error {
+	if err := kv.db.Sync(); err != nil {
+		return fmt.Errorf("could not flush local writes: %w", err)
+	}
+	return kv.push()
+}
+
+// push streams a Badger backup of everything written since the last
+// successful push to the server over a dedicated SSH session, advancing
+// syncedUpTo once the server acknowledges it.
+func (kv *KV) push() error {
+	sess, err := kv.cc.Session()
+	if err != nil {
+		return fmt.Errorf("could not open sync session: %w", err)
+	}
+	defer sess.Close() //nolint:errcheck
+
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("could not attach to sync session: %w", err)
+	}
+
+	if err := sess.Start(fmt.Sprintf("kv-sync %s", kv.name)); err != nil {
+		return fmt.Errorf("could not start sync session: %w", err)
+	}
+
+	next, err := kv.db.Backup(stdin, kv.syncedUpTo)
+	if err != nil {
+		return fmt.Errorf("could not back up local writes: %w", err)
+	}
+	if err := stdin.Close(); err != nil {
+		return fmt.Errorf("could not finish sending backup: %w", err)
+	}
+	if err := sess.Wait(); err != nil {
+		return fmt.Errorf("server rejected sync: %w", err)
+	}
+
+	kv.syncedUpTo = next
+	return nil
+}
+
+// Keys returns all of the keys currently in the store.
+func (kv *KV) Keys() ([][]byte, error) {
+	var keys [][]byte
+	err := kv.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list keys: %w", err)
+	}
+	return keys, nil
+}
+
+// ErrCompareFailed is returned by CompareAndSwap and CompareAndSwapIndex when
+// the value or revision currently stored for a key doesn't match what the
+// caller expected. Value holds whatever is actually stored for the key at
+// the time of the check, so callers can decide whether to retry.
+type ErrCompareFailed struct {
+	Key   []byte
+	Value []byte
+}
+
+// Error implements the error interface.
+func (e *ErrCompareFailed) Error() string {
+	return fmt.Sprintf("kv: compare failed for key %q", e.Key)
+}
+
+// Is reports whether target is also an *ErrCompareFailed, so callers can
+// use errors.Is(err, new(ErrCompareFailed)) without caring about the
+// specific key or value involved.
+func (e *ErrCompareFailed) Is(target error) bool {
+	_, ok := target.(*ErrCompareFailed)
+	return ok
+}
+
+// PrevValue returns the value currently stored for key along with its
+// Badger revision, which can be passed to CompareAndSwapIndex. It's a
+// convenience wrapper so callers building locks or leases on top of
+// CompareAndSwapIndex don't have to reach into Badger directly.
+func (kv *KV) PrevValue(key []byte) ([]byte, uint64, error) {
+	if len(key) == 0 {
+		return nil, 0, ErrEmptyKey
+	}
+	var value []byte
+	var rev uint64
+	err := kv.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		rev = item.Version()
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, 0, fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not get prev value for key %q: %w", key, err)
+	}
+	return value, rev, nil
+}
+
+// casRequest is the JSON request CompareAndSwap, CompareAndSwapIndex, and
+// CreateIfAbsent send to the server's kv-cas command.
+type casRequest struct {
+	Key       []byte `json:"key"`
+	NewValue  []byte `json:"newValue"`
+	PrevValue []byte `json:"prevValue,omitempty"`
+	PrevIndex uint64 `json:"prevIndex,omitempty"`
+	ByIndex   bool   `json:"byIndex"`
+	IfAbsent  bool   `json:"ifAbsent"`
+}
+
+// casResponse is the JSON response the server's kv-cas command writes back
+// once it has checked the request against its authoritative copy of the
+// key and, if it matched, applied the write.
+type casResponse struct {
+	OK    bool   `json:"ok"`
+	Value []byte `json:"value,omitempty"`
+}
+
+// cas runs a compare-and-swap against this KV's copy on the Charm server,
+// which holds the single authoritative revision for every *KV opened
+// against this name for the Charm user behind cc. The server checks and
+// writes in one step, so concurrent *KV instances racing on the same key,
+// even from separate processes, see exactly one winner. On success, the
+// write is also applied to the local Badger handle so Get reflects it
+// immediately, without waiting for a Sync.
+func (kv *KV) cas(req casRequest) ([]byte, error) {
+	sess, err := kv.cc.Session()
+	if err != nil {
+		return nil, fmt.Errorf("could not open cas session: %w", err)
+	}
+	defer sess.Close() //nolint:errcheck
+
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not attach to cas session: %w", err)
+	}
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not attach to cas session: %w", err)
+	}
+	if err := sess.Start(fmt.Sprintf("kv-cas %s", kv.name)); err != nil {
+		return nil, fmt.Errorf("could not start cas session: %w", err)
+	}
+
+	if err := json.NewEncoder(stdin).Encode(req); err != nil {
+		return nil, fmt.Errorf("could not send cas request: %w", err)
+	}
+	if err := stdin.Close(); err != nil {
+		return nil, fmt.Errorf("could not finish sending cas request: %w", err)
+	}
+
+	var resp casResponse
+	if err := json.NewDecoder(stdout).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("could not read cas response: %w", err)
+	}
+	if err := sess.Wait(); err != nil {
+		return nil, fmt.Errorf("server rejected cas: %w", err)
+	}
+
+	if !resp.OK {
+		return nil, &ErrCompareFailed{Key: req.Key, Value: resp.Value}
+	}
+
+	if err := kv.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(req.Key, req.NewValue)
+	}); err != nil {
+		return nil, fmt.Errorf("could not apply cas locally: %w", err)
+	}
+
+	return resp.Value, nil
+}
+
+// CompareAndSwap sets key to newValue only if the value currently stored for
+// key is equal to prevValue. If the stored value differs, it returns
+// *ErrCompareFailed carrying the value that was actually found.
+//
+// The compare and the write happen together on the Charm server, so
+// CompareAndSwap is atomic across every *KV a Charm user has open for this
+// name, not just callers sharing this process's Badger handle — the
+// guarantee callers build locks and leases on.
+func (kv *KV) CompareAndSwap(key, newValue, prevValue []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	_, err := kv.cas(casRequest{Key: key, NewValue: newValue, PrevValue: prevValue})
+	return err
+}
+
+// CompareAndSwapIndex sets key to newValue only if the revision currently
+// stored for key, as returned by PrevValue, is equal to prevIndex. If the
+// stored revision differs, it returns *ErrCompareFailed carrying the value
+// that was actually found. Like CompareAndSwap, the check and the write
+// happen together on the Charm server, so this is atomic across every *KV
+// a Charm user has open for this name.
+func (kv *KV) CompareAndSwapIndex(key, newValue []byte, prevIndex uint64) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	_, err := kv.cas(casRequest{Key: key, NewValue: newValue, PrevIndex: prevIndex, ByIndex: true})
+	return err
+}
+
+// CreateIfAbsent sets key to value only if key does not already exist. If
+// key is already present, it returns *ErrCompareFailed carrying the value
+// that's already stored. Like CompareAndSwap, the check and the write
+// happen together on the Charm server, so this is atomic across every *KV
+// a Charm user has open for this name.
+func (kv *KV) CreateIfAbsent(key, value []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	_, err := kv.cas(casRequest{Key: key, NewValue: value, IfAbsent: true})
+	return err
+}
+
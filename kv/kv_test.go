@@ -2,16 +2,20 @@ package kv
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/charmbracelet/charm/client"
 	"github.com/charmbracelet/charm/server"
+	"github.com/charmbracelet/charm/testserver"
 	"github.com/charmbracelet/keygen"
 	badger "github.com/dgraph-io/badger/v3"
 )
@@ -68,11 +72,16 @@ func fetchURL(url string, retries int) (*http.Response, error) {
 
 func setup(t *testing.T) *KV {
 	t.Helper()
-	opt := badger.DefaultOptions("").WithInMemory(true)
 	cc, err := client.NewClientWithDefaults()
 	if err != nil {
 		log.Fatal(err)
 	}
+	return setupWithClient(t, cc)
+}
+
+func setupWithClient(t *testing.T, cc *client.Client) *KV {
+	t.Helper()
+	opt := badger.DefaultOptions("").WithInMemory(true)
 	kv, err := Open(cc, "test", opt)
 	if err != nil {
 		log.Fatal(err)
@@ -86,8 +95,8 @@ func TestGetForEmptyDB(t *testing.T) {
 	startServer(t, "get for empty DB", func() {
 		kv := setup(t)
 		_, err := kv.Get([]byte("1234"))
-		if err == nil {
-			t.Errorf("expected error")
+		if !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("expected ErrKeyNotFound, got %v", err)
 		}
 	})
 }
@@ -98,19 +107,19 @@ func TestGet(t *testing.T) {
 			testname  string
 			key       []byte
 			want      []byte
-			expectErr bool
+			expectErr error
 		}{
-			{"valid kv pair", []byte("1234"), []byte("valid"), false},
-			{"invalid key", []byte{}, []byte{}, true},
+			{"valid kv pair", []byte("1234"), []byte("valid"), nil},
+			{"invalid key", []byte{}, []byte{}, ErrEmptyKey},
 		}
 
 		for _, tc := range tests {
 			kv := setup(t)
 			kv.Set(tc.key, tc.want)
 			got, err := kv.Get(tc.key)
-			if tc.expectErr {
-				if err == nil {
-					t.Errorf("%s: expected error", tc.testname)
+			if tc.expectErr != nil {
+				if !errors.Is(err, tc.expectErr) {
+					t.Errorf("%s: expected %v, got %v", tc.testname, tc.expectErr, err)
 				}
 			} else {
 				if err != nil {
@@ -167,19 +176,19 @@ func TestDelete(t *testing.T) {
 			testname  string
 			key       []byte
 			value     []byte
-			expectErr bool
+			expectErr error
 		}{
-			{"valid key", []byte("hello"), []byte("value"), false},
-			{"empty key with value", []byte{}, []byte("value"), true},
-			{"empty key no value", []byte{}, []byte{}, true},
+			{"valid key", []byte("hello"), []byte("value"), nil},
+			{"empty key with value", []byte{}, []byte("value"), ErrEmptyKey},
+			{"empty key no value", []byte{}, []byte{}, ErrEmptyKey},
 		}
 
 		for _, tc := range tests {
 			kv := setup(t)
 			kv.Set(tc.key, tc.value)
-			if tc.expectErr {
-				if err := kv.Delete(tc.key); err == nil {
-					t.Errorf("%s: expected error", tc.testname)
+			if tc.expectErr != nil {
+				if err := kv.Delete(tc.key); !errors.Is(err, tc.expectErr) {
+					t.Errorf("%s: expected %v, got %v", tc.testname, tc.expectErr, err)
 				}
 			} else {
 				if err := kv.Delete(tc.key); err != nil {
@@ -194,6 +203,209 @@ func TestDelete(t *testing.T) {
 	})
 }
 
+// TestCompareAndSwap
+
+func TestCompareAndSwap(t *testing.T) {
+	startServer(t, "compare and swap", func() {
+		kv := setup(t)
+		key := []byte("lock")
+
+		if err := kv.Set(key, []byte("v1")); err != nil {
+			t.Fatalf("unexpected error setting up key: %s", err)
+		}
+		if err := kv.Sync(); err != nil {
+			t.Fatalf("unexpected error syncing key: %s", err)
+		}
+
+		if err := kv.CompareAndSwap(key, []byte("v2"), []byte("v1")); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+
+		err := kv.CompareAndSwap(key, []byte("v3"), []byte("wrong prev"))
+		var cfe *ErrCompareFailed
+		if !errors.As(err, &cfe) {
+			t.Fatalf("expected *ErrCompareFailed, got %v", err)
+		}
+		if bytes.Compare(cfe.Value, []byte("v2")) != 0 {
+			t.Errorf("got stored value %s, want %s", cfe.Value, "v2")
+		}
+	})
+}
+
+func TestCompareAndSwapIndex(t *testing.T) {
+	startServer(t, "compare and swap index", func() {
+		kv := setup(t)
+		key := []byte("lock")
+
+		if err := kv.Set(key, []byte("v1")); err != nil {
+			t.Fatalf("unexpected error setting up key: %s", err)
+		}
+		if err := kv.Sync(); err != nil {
+			t.Fatalf("unexpected error syncing key: %s", err)
+		}
+
+		_, rev, err := kv.PrevValue(key)
+		if err != nil {
+			t.Fatalf("unexpected error getting prev value: %s", err)
+		}
+
+		if err := kv.CompareAndSwapIndex(key, []byte("v2"), rev); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+
+		err = kv.CompareAndSwapIndex(key, []byte("v3"), rev)
+		var cfe *ErrCompareFailed
+		if !errors.As(err, &cfe) {
+			t.Fatalf("expected *ErrCompareFailed, got %v", err)
+		}
+	})
+}
+
+// TestCompareAndSwapConcurrent exercises CompareAndSwap's cross-process
+// atomicity guarantee: two independent *KV handles for the same Charm
+// user, each backed by its own local Badger database, race on one key
+// through the server's kv-cas command and must see exactly one winner.
+func TestCompareAndSwapConcurrent(t *testing.T) {
+	cc := testserver.SetupTestServer(t)
+	kv1 := setupWithClient(t, cc)
+	kv2 := setupWithClient(t, cc)
+	key := []byte("race")
+
+	if err := kv1.CreateIfAbsent(key, []byte("0")); err != nil {
+		t.Fatalf("unexpected error setting up key: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	var successes int32
+	var mu sync.Mutex
+
+	race := func(kv *KV) {
+		defer wg.Done()
+		if err := kv.CompareAndSwap(key, []byte("1"), []byte("0")); err == nil {
+			mu.Lock()
+			successes++
+			mu.Unlock()
+		}
+	}
+
+	wg.Add(2)
+	go race(kv1)
+	go race(kv2)
+	wg.Wait()
+
+	if successes != 1 {
+		t.Errorf("expected exactly one winner, got %d", successes)
+	}
+}
+
+func TestCreateIfAbsent(t *testing.T) {
+	startServer(t, "create if absent", func() {
+		kv := setup(t)
+		key := []byte("new-key")
+
+		if err := kv.CreateIfAbsent(key, []byte("first")); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+
+		err := kv.CreateIfAbsent(key, []byte("second"))
+		var cfe *ErrCompareFailed
+		if !errors.As(err, &cfe) {
+			t.Fatalf("expected *ErrCompareFailed, got %v", err)
+		}
+		if bytes.Compare(cfe.Value, []byte("first")) != 0 {
+			t.Errorf("got stored value %s, want %s", cfe.Value, "first")
+		}
+	})
+}
+
+// TestWatch
+
+// TestWatch runs against a real testserver instance so the watcher and
+// writer are two separate *KV handles sharing one *client.Client — i.e.
+// the same Charm user — rather than two disconnected local databases that
+// could never see each other's writes. The writer calls Sync after each
+// mutation to push it to the server, which is what the server-side watch
+// tap actually observes.
+func TestWatch(t *testing.T) {
+	cc := testserver.SetupTestServer(t)
+
+	watcher := setupWithClient(t, cc)
+	writer := setupWithClient(t, cc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := watcher.Watch(ctx, []byte("watched-"))
+	if err != nil {
+		t.Fatalf("unexpected error starting watch: %s", err)
+	}
+
+	if err := writer.Set([]byte("watched-1"), []byte("hello")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := writer.Sync(); err != nil {
+		t.Fatalf("unexpected error syncing put: %s", err)
+	}
+	if err := writer.Delete([]byte("watched-1")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := writer.Sync(); err != nil {
+		t.Fatalf("unexpected error syncing delete: %s", err)
+	}
+
+	var got []WatchEvent
+	for len(got) < 2 {
+		select {
+		case ev, ok := <-w.Events():
+			if !ok {
+				t.Fatalf("watch ended early: %v", w.Err())
+			}
+			got = append(got, ev)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for watch events, got %d", len(got))
+		}
+	}
+
+	if got[0].Type != EventPut {
+		t.Errorf("expected first event to be a put, got %v", got[0].Type)
+	}
+	if got[1].Type != EventDelete {
+		t.Errorf("expected second event to be a delete, got %v", got[1].Type)
+	}
+
+	// Cancelling ctx, rather than the session failing, should close Events
+	// with a nil Err.
+	cancel()
+	if _, ok := <-w.Events(); ok {
+		t.Errorf("expected Events to close once ctx is done")
+	}
+	if err := w.Err(); err != nil {
+		t.Errorf("expected nil Err after a clean ctx cancellation, got %v", err)
+	}
+}
+
+// TestSetWithTTL
+
+func TestSetWithTTL(t *testing.T) {
+	startServer(t, "set with ttl", func() {
+		kv := setup(t)
+		key := []byte("lease")
+
+		if err := kv.Set(key, []byte("value"), WithTTL(2*time.Second)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if _, err := kv.Get(key); err != nil {
+			t.Errorf("unexpected error reading unexpired key: %s", err)
+		}
+
+		time.Sleep(3 * time.Second)
+		if _, err := kv.Get(key); err == nil {
+			t.Errorf("expected error reading expired key")
+		}
+	})
+}
+
 // TestSync
 
 func TestSync(t *testing.T) {
@@ -211,8 +423,8 @@ func TestSync(t *testing.T) {
 func TestOptionsWithEncryption(t *testing.T) {
 	startServer(t, "set reader", func() {
 		_, err := OptionsWithEncryption(badger.DefaultOptions(""), []byte("1234"), -2)
-		if err == nil {
-			t.Errorf("expected an error")
+		if !errors.Is(err, ErrInvalidKeyRotationDuration) {
+			t.Errorf("expected ErrInvalidKeyRotationDuration, got %v", err)
 		}
 	})
 }
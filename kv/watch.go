@@ -0,0 +1,170 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// defaultMaxWatchMessageSize is the largest single WatchEvent value Watch
+// will deliver by default. Values larger than this (for example blobs set
+// via SetReader) come through as an EventTooLarge event carrying no Value,
+// rather than being silently dropped or truncated; raise the limit for a
+// given KV with WithMaxWatchMessageSize if your workload needs it.
+const defaultMaxWatchMessageSize = 1 << 20 // 1MB
+
+// EventType describes the kind of change a WatchEvent represents.
+type EventType int
+
+const (
+	// EventPut indicates a key was created or updated.
+	EventPut EventType = iota
+	// EventDelete indicates a key was deleted.
+	EventDelete
+	// EventTooLarge indicates a change occurred for Key, but its value
+	// exceeded the configured max watch message size and was not sent.
+	// Callers that need it should Get the key directly.
+	EventTooLarge
+)
+
+// WatchEvent describes a single change to a watched key.
+type WatchEvent struct {
+	Key   []byte
+	Value []byte
+	Rev   uint64
+	Type  EventType
+}
+
+// wireEvent is the JSON line shape the server's kv-watch command writes to
+// its stdout, one change per line. Value is the ciphertext for the key as
+// stored server-side; the client decrypts it with the Charm user's key
+// before handing a WatchEvent to callers.
+type wireEvent struct {
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value,omitempty"`
+	Rev    uint64 `json:"rev"`
+	Delete bool   `json:"delete"`
+}
+
+// Option configures optional KV behavior, set at Open time.
+type Option func(*KV)
+
+// WithMaxWatchMessageSize overrides the maximum size, in bytes, of a single
+// WatchEvent's value that Watch will deliver. Use this when values such as
+// blobs set via SetReader can exceed the default limit.
+func WithMaxWatchMessageSize(n int) Option {
+	return func(kv *KV) {
+		kv.maxWatchMessageSize = n
+	}
+}
+
+// Watcher streams the change events for a single Watch call. Once Events
+// is closed, Err reports why: nil if ctx ended the watch, or the error
+// that broke the underlying session otherwise.
+type Watcher struct {
+	events chan WatchEvent
+
+	mu  sync.Mutex
+	err error
+}
+
+// Events returns the channel of change events for this watch. It's closed
+// when the underlying session ends, at which point Err reports why.
+func (w *Watcher) Events() <-chan WatchEvent {
+	return w.events
+}
+
+// Err returns the error that ended the watch, if any. It's only meaningful
+// once Events has been closed.
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *Watcher) setErr(err error) {
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+}
+
+// Watch opens a long-lived SSH session to the Charm server and streams
+// change events for keys matching prefix in this KV's named DB, until ctx
+// is done or the session ends, at which point the returned Watcher's
+// Events channel is closed. The server taps Badger's own Subscribe for the
+// underlying DB and forwards matching changes over the session's stdout;
+// Watch decrypts each value with the Charm user's key before delivering
+// it. Watch only sees changes once they're pushed to the server, so
+// writers must call Sync after Set/Delete for their changes to show up
+// here.
+func (kv *KV) Watch(ctx context.Context, prefix []byte) (*Watcher, error) {
+	sess, err := kv.cc.Session()
+	if err != nil {
+		return nil, fmt.Errorf("could not open watch session: %w", err)
+	}
+
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not attach to watch session: %w", err)
+	}
+
+	if err := sess.Start(fmt.Sprintf("kv-watch %s %x %d", kv.name, prefix, kv.maxWatchMessageSize)); err != nil {
+		return nil, fmt.Errorf("could not start watch session: %w", err)
+	}
+
+	w := &Watcher{events: make(chan WatchEvent)}
+	done := make(chan struct{})
+
+	// Closes the session when ctx is done, but stops watching ctx the
+	// moment the read loop below exits for any other reason, so it never
+	// outlives a ctx that's held open past the end of this watch.
+	go func() {
+		select {
+		case <-ctx.Done():
+			sess.Close() //nolint:errcheck
+		case <-done:
+		}
+	}()
+
+	go func() {
+		defer close(done)
+		defer close(w.events)
+		defer sess.Close() //nolint:errcheck
+
+		dec := json.NewDecoder(stdout)
+		for {
+			var we wireEvent
+			if err := dec.Decode(&we); err != nil {
+				if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+					w.setErr(fmt.Errorf("watch session ended: %w", err))
+				}
+				return
+			}
+
+			ev := WatchEvent{Key: we.Key, Rev: we.Rev, Type: EventPut}
+			switch {
+			case we.Delete:
+				ev.Type = EventDelete
+			case len(we.Value) > kv.maxWatchMessageSize:
+				ev.Type = EventTooLarge
+			default:
+				value, err := kv.cc.Decrypt(we.Value)
+				if err != nil {
+					continue
+				}
+				ev.Value = value
+			}
+
+			select {
+			case w.events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return w, nil
+}
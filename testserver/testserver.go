@@ -2,6 +2,7 @@ package testserver
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
@@ -25,6 +26,11 @@ type Clients struct {
 
 	// NoAgent is a client without the ssh agent option set.
 	NoAgent *client.Client
+
+	sshAddr string
+	hostKey ssh.PublicKey
+	signers []ssh.Signer
+	agent   *sshagent.Agent
 }
 
 // SetupTestServerWithAgent starts a test server and a fake ssh agent with
@@ -57,6 +63,11 @@ func SetupTestServerWithAgent(tb testing.TB, signers ...ssh.Signer) Clients {
 		tb.Fatalf("new server error: %s", err)
 	}
 
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(kp.PublicKey()))
+	if err != nil {
+		tb.Fatalf("could not parse server host key: %s", err)
+	}
+
 	_ = os.Setenv("CHARM_HOST", cfg.Host)
 	_ = os.Setenv("CHARM_SSH_PORT", fmt.Sprintf("%d", cfg.SSHPort))
 	_ = os.Setenv("CHARM_HTTP_PORT", fmt.Sprintf("%d", cfg.HTTPPort))
@@ -105,7 +116,12 @@ func SetupTestServerWithAgent(tb testing.TB, signers ...ssh.Signer) Clients {
 		}
 	})
 
-	var clients Clients
+	clients := Clients{
+		sshAddr: fmt.Sprintf("%s:%d", cfg.Host, cfg.SSHPort),
+		hostKey: hostKey,
+		signers: signers,
+		agent:   agt,
+	}
 
 	ccfg, err := client.ConfigFromEnv()
 	if err != nil {
@@ -147,6 +163,92 @@ func SetupTestServerWithAgent(tb testing.TB, signers ...ssh.Signer) Clients {
 	return clients
 }
 
+// DialSSH dials the test server over SSH, authenticating with the signers
+// given to SetupTestServerWithAgent, and returns a live, already-handshaked
+// client. It's meant for downstream modules that need to exercise real SSH
+// behavior (port forwarding, exec, agent forwarding) rather than going
+// through the higher-level charm client.
+func (c Clients) DialSSH() (*ssh.Client, error) {
+	if len(c.signers) == 0 {
+		return nil, fmt.Errorf("no signers were given to SetupTestServerWithAgent")
+	}
+	cfg := &ssh.ClientConfig{
+		User:            "charm",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(c.signers...)},
+		HostKeyCallback: ssh.FixedHostKey(c.hostKey),
+	}
+	sshClient, err := ssh.Dial("tcp", c.sshAddr, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not dial test server over ssh: %w", err)
+	}
+	return sshClient, nil
+}
+
+// ForwardTCP dials the test server over SSH and opens a local listener that
+// forwards every connection it accepts to remoteAddr via the server's
+// direct-tcpip handler, the same path an SSH `-L` port forward takes.
+func (c Clients) ForwardTCP(localAddr, remoteAddr string) (net.Listener, error) {
+	sc, err := c.DialSSH()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		sc.Close() //nolint:errcheck
+		return nil, fmt.Errorf("could not listen on %s: %w", localAddr, err)
+	}
+	go func() {
+		defer sc.Close() //nolint:errcheck
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go forwardConn(sc, conn, remoteAddr)
+		}
+	}()
+	return ln, nil
+}
+
+func forwardConn(sc *ssh.Client, conn net.Conn, remoteAddr string) {
+	defer conn.Close() //nolint:errcheck
+	remote, err := sc.Dial("tcp", remoteAddr)
+	if err != nil {
+		return
+	}
+	defer remote.Close() //nolint:errcheck
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(remote, conn)
+		close(done)
+	}()
+	_, _ = io.Copy(conn, remote)
+	<-done
+}
+
+// RunSession dials the test server over SSH, opens a session, and runs cmd
+// on it, returning its combined stdout and stderr.
+func (c Clients) RunSession(cmd string) ([]byte, error) {
+	sc, err := c.DialSSH()
+	if err != nil {
+		return nil, err
+	}
+	defer sc.Close() //nolint:errcheck
+
+	session, err := sc.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("could not open ssh session: %w", err)
+	}
+	defer session.Close() //nolint:errcheck
+
+	out, err := session.CombinedOutput(cmd)
+	if err != nil {
+		return out, fmt.Errorf("could not run %q: %w", cmd, err)
+	}
+	return out, nil
+}
+
 // SetupTestServer starts a test server and sets the needed environment
 // variables so clients pick it up.
 // It also returns a client forcing these settings in.
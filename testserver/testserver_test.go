@@ -0,0 +1,264 @@
+package testserver
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate test key: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("could not create signer: %s", err)
+	}
+	return signer
+}
+
+func TestDialSSH(t *testing.T) {
+	signer := newTestSigner(t)
+	clients := SetupTestServerWithAgent(t, signer)
+
+	sc, err := clients.DialSSH()
+	if err != nil {
+		t.Fatalf("could not dial ssh: %s", err)
+	}
+	defer sc.Close() //nolint:errcheck
+}
+
+func TestDialSSHNoSigners(t *testing.T) {
+	clients := SetupTestServerWithAgent(t)
+
+	if _, err := clients.DialSSH(); err == nil {
+		t.Fatalf("expected an error dialing without signers")
+	}
+}
+
+func TestRunSession(t *testing.T) {
+	signer := newTestSigner(t)
+	clients := SetupTestServerWithAgent(t, signer)
+
+	out, err := clients.RunSession("id")
+	if err != nil {
+		t.Fatalf("could not run session: %s", err)
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		t.Errorf("expected RunSession to return the authenticated user's charm ID, got empty output")
+	}
+}
+
+func TestForwardTCP(t *testing.T) {
+	signer := newTestSigner(t)
+	clients := SetupTestServerWithAgent(t, signer)
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not start echo listener: %s", err)
+	}
+	defer echo.Close() //nolint:errcheck
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() //nolint:errcheck
+				buf := make([]byte, 5)
+				if _, err := conn.Read(buf); err != nil {
+					return
+				}
+				_, _ = conn.Write(buf)
+			}()
+		}
+	}()
+
+	ln, err := clients.ForwardTCP("127.0.0.1:0", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("could not forward tcp: %s", err)
+	}
+	defer ln.Close() //nolint:errcheck
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("could not dial forwarded listener: %s", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("could not write: %s", err)
+	}
+	got := make([]byte, 5)
+	if _, err := conn.Read(got); err != nil {
+		t.Fatalf("could not read echoed bytes: %s", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+// TestDialSSHAgentForwarding checks that the test server accepts an agent
+// forwarding request, and that a signer held only in the fake ssh agent can
+// authenticate a nested SSH hop: it registers the fake agent for forwarding
+// on the connection to the test server and requests forwarding on a
+// session, then reads the agent's signers over its local socket and uses
+// them, on their own, to authenticate and run a command against a second,
+// independent SSH server. The signers are read from the agent's socket
+// directly, not back through the test server, and the nested hop is dialed
+// directly rather than through the test server.
+func TestDialSSHAgentForwarding(t *testing.T) {
+	signer := newTestSigner(t)
+	clients := SetupTestServerWithAgent(t, signer)
+
+	sc, err := clients.DialSSH()
+	if err != nil {
+		t.Fatalf("could not dial ssh: %s", err)
+	}
+	defer sc.Close() //nolint:errcheck
+
+	conn, err := net.Dial("unix", clients.agent.Socket())
+	if err != nil {
+		t.Fatalf("could not dial fake ssh agent: %s", err)
+	}
+	defer conn.Close() //nolint:errcheck
+	agentClient := agent.NewClient(conn)
+
+	if err := agent.ForwardToAgent(sc, agentClient); err != nil {
+		t.Fatalf("could not forward agent over ssh connection: %s", err)
+	}
+
+	session, err := sc.NewSession()
+	if err != nil {
+		t.Fatalf("could not open session: %s", err)
+	}
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		session.Close() //nolint:errcheck
+		t.Fatalf("could not request agent forwarding on session: %s", err)
+	}
+	session.Close() //nolint:errcheck
+
+	nestedSigners, err := agentClient.Signers()
+	if err != nil {
+		t.Fatalf("could not list signers from the forwarded agent: %s", err)
+	}
+	if len(nestedSigners) == 0 {
+		t.Fatalf("forwarded agent exposed no signers")
+	}
+
+	nestedAddr, stop := startNestedSSHServer(t, nestedSigners[0].PublicKey())
+	defer stop()
+
+	nestedClient, err := ssh.Dial("tcp", nestedAddr, &ssh.ClientConfig{
+		User:            "charm",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(nestedSigners...)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //nolint:gosec
+	})
+	if err != nil {
+		t.Fatalf("nested hop could not authenticate using the forwarded agent's signer: %s", err)
+	}
+	defer nestedClient.Close() //nolint:errcheck
+
+	nestedSession, err := nestedClient.NewSession()
+	if err != nil {
+		t.Fatalf("could not open session on nested hop: %s", err)
+	}
+	defer nestedSession.Close() //nolint:errcheck
+
+	out, err := nestedSession.CombinedOutput("echo hop-ok")
+	if err != nil {
+		t.Fatalf("nested hop exec failed: %s", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "hop-ok" {
+		t.Errorf("nested hop exec: got %q, want %q", got, "hop-ok")
+	}
+}
+
+// startNestedSSHServer starts a minimal SSH server, independent of the
+// charm test server, that only accepts authorizedKey and only understands
+// "echo <text>" exec requests. It stands in for whatever real service a
+// nested SSH hop, authenticated with a forwarded agent, would reach.
+func startNestedSSHServer(t *testing.T, authorizedKey ssh.PublicKey) (addr string, stop func()) {
+	t.Helper()
+
+	hostSigner := newTestSigner(t)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not start nested listener: %s", err)
+	}
+
+	go func() {
+		for {
+			nConn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleNestedConn(nConn, config)
+		}
+	}()
+
+	return ln.Addr().String(), func() { ln.Close() } //nolint:errcheck
+}
+
+func handleNestedConn(nConn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(nConn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			_ = newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		ch, requests, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go serveNestedSession(ch, requests)
+	}
+}
+
+func serveNestedSession(ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close() //nolint:errcheck
+	for req := range requests {
+		if req.Type != "exec" {
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+			continue
+		}
+
+		var payload struct{ Command string }
+		_ = ssh.Unmarshal(req.Payload, &payload)
+		if req.WantReply {
+			_ = req.Reply(true, nil)
+		}
+
+		fmt.Fprintln(ch, strings.TrimPrefix(payload.Command, "echo "))
+		_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		return
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/charmbracelet/charm"
 	"github.com/charmbracelet/charm/ui/common"
+	"github.com/charmbracelet/keygen"
 	"github.com/charmbracelet/tea"
 	"github.com/charmbracelet/teaparty/spinner"
 	"github.com/muesli/reflow/indent"
@@ -117,7 +118,7 @@ func View(model tea.Model) string {
 		s += termenv.String("✔").Foreground(common.Green.Color()).String()
 		s += "  Done!"
 	case statusError:
-		s += fmt.Sprintf("Uh oh, there's been an error: %v", m.err)
+		s += errorMessage(m.err)
 	case statusQuitting:
 		s += "Exiting..."
 	}
@@ -129,6 +130,18 @@ func View(model tea.Model) string {
 	return s
 }
 
+// errorMessage renders a user-facing message for err, calling out the one
+// failure mode GenerateKeys's call to charm.NewSSHKeyPair can return that
+// users hit in practice: a key pair already sitting on disk.
+func errorMessage(err error) string {
+	switch {
+	case errors.Is(err, keygen.ErrKeyExists):
+		return "Looks like you already have a Charm key pair on disk. Nothing to do!"
+	default:
+		return fmt.Sprintf("Uh oh, there's been an error: %v", err)
+	}
+}
+
 // SUBSCRIPTIONS
 
 func Subscriptions(model tea.Model) tea.Subs {